@@ -0,0 +1,238 @@
+// Package admin provides administrative operations over consumer groups
+// registered in ZooKeeper: listing, describing and deleting groups, and
+// inspecting or altering their committed offsets. It is meant for operator
+// tooling that needs to remediate a stuck group without reaching for
+// external ZooKeeper clients.
+//
+// T's methods are deliberately plain: a context.Context plus request
+// parameters in, a value plus error out. That shape is what the rest of
+// this codebase's HTTP and gRPC proxy handlers expect, so wiring, say,
+// `DescribeGroup` behind a `GET /groups/{group}` endpoint is a thin
+// handler, not a redesign. That wiring is not done in this package: the
+// tree this package lives in does not (yet) check in the proxy's handler
+// layer, so there is nothing here for T's methods to be registered with.
+package admin
+
+import (
+	"context"
+
+	"github.com/mailgun/kafka-pixy/consumer/groupmember"
+	"github.com/pkg/errors"
+	"github.com/wvanbergen/kazoo-go"
+)
+
+// GroupSummary is a minimal identifier of a consumer group, as returned by
+// ListGroups.
+type GroupSummary struct {
+	Group string
+}
+
+// TopicPartition identifies a single partition of a topic.
+type TopicPartition struct {
+	Topic     string
+	Partition int32
+}
+
+// T provides administrative operations over consumer groups. Unlike
+// `groupmember.T` it does not maintain a live registration of its own:
+// every call reads ZooKeeper directly via the shared kazoo client.
+type T struct {
+	kazooClt *kazoo.Kazoo
+}
+
+// New creates a group admin handle that reuses the given kazoo client,
+// rather than opening a ZooKeeper connection of its own.
+func New(kazooClt *kazoo.Kazoo) *T {
+	return &T{kazooClt: kazooClt}
+}
+
+// ListGroups enumerates all consumer groups registered in ZooKeeper.
+func (a *T) ListGroups(ctx context.Context) ([]GroupSummary, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	groups, err := a.kazooClt.Consumergroups()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list groups")
+	}
+	summaries := make([]GroupSummary, len(groups))
+	for i, group := range groups {
+		summaries[i] = GroupSummary{Group: group.Name}
+	}
+	return summaries, nil
+}
+
+// DescribeGroup returns the membership, subscriptions, pattern, claimed
+// partitions and user data of a consumer group as currently recorded in
+// ZooKeeper. For a group this proxy itself is a member of,
+// `groupmember.T.Describe` is cheaper since it avoids the ZooKeeper round
+// trips this makes, though it reports no claimed partitions at all.
+func (a *T) DescribeGroup(ctx context.Context, group string) (groupmember.GroupDescription, error) {
+	if err := ctx.Err(); err != nil {
+		return groupmember.GroupDescription{}, err
+	}
+	groupZNode := a.kazooClt.Consumergroup(group)
+	instances, err := groupZNode.Instances()
+	if err != nil {
+		return groupmember.GroupDescription{}, errors.Wrapf(err, "failed to list members, group=%s", group)
+	}
+	knownTopics, err := a.kazooClt.Topics()
+	if err != nil {
+		return groupmember.GroupDescription{}, errors.Wrapf(err, "failed to list cluster topics, group=%s", group)
+	}
+	knownTopicNames := make([]string, len(knownTopics))
+	for i, topic := range knownTopics {
+		knownTopicNames[i] = topic.Name
+	}
+	members := make(map[string]groupmember.MemberDescription, len(instances))
+	for _, instance := range instances {
+		if err := ctx.Err(); err != nil {
+			return groupmember.GroupDescription{}, err
+		}
+		data, _, err := a.kazooClt.Connection().Get(instance.Path())
+		if err != nil {
+			return groupmember.GroupDescription{}, errors.Wrapf(err,
+				"failed to fetch registration, group=%s, member=%s", group, instance.ID)
+		}
+		pattern, topicsOrPatterns, userData, err := groupmember.ParseRegistration(data)
+		if err != nil {
+			return groupmember.GroupDescription{}, errors.Wrapf(err,
+				"failed to parse registration, group=%s, member=%s", group, instance.ID)
+		}
+		topics, err := groupmember.ExpandSubscription(pattern, topicsOrPatterns, knownTopicNames)
+		if err != nil {
+			return groupmember.GroupDescription{}, errors.Wrapf(err,
+				"failed to expand subscription, group=%s, member=%s", group, instance.ID)
+		}
+		claimed, err := a.claimedPartitions(groupZNode, instance.ID, topics)
+		if err != nil {
+			return groupmember.GroupDescription{}, errors.Wrapf(err,
+				"failed to list claimed partitions, group=%s, member=%s", group, instance.ID)
+		}
+		members[instance.ID] = groupmember.MemberDescription{
+			Topics:            topics,
+			Pattern:           pattern,
+			ClaimedPartitions: claimed,
+			UserData:          userData,
+		}
+	}
+	return groupmember.GroupDescription{Group: group, Members: members}, nil
+}
+
+// claimedPartitions reads the owner znode of every partition of `topics`
+// and reports the ones currently claimed by `memberID`, keyed by topic.
+func (a *T) claimedPartitions(groupZNode *kazoo.Consumergroup, memberID string, topics []string) (map[string][]int32, error) {
+	var claims map[string][]int32
+	for _, topicName := range topics {
+		partitions, err := a.kazooClt.Topic(topicName).Partitions()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list partitions, topic=%s", topicName)
+		}
+		for _, partition := range partitions {
+			owner, err := groupZNode.PartitionOwner(topicName, partition.ID)
+			if err != nil && err != kazoo.ErrPartitionNotClaimed {
+				return nil, errors.Wrapf(err, "failed to check owner, topic=%s, partition=%d", topicName, partition.ID)
+			}
+			ownerID := ""
+			if owner != nil {
+				ownerID = owner.ID
+			}
+			claims = addClaimIfOwned(claims, memberID, topicName, partition.ID, ownerID)
+		}
+	}
+	return claims, nil
+}
+
+// addClaimIfOwned records that `partition` of `topic` is claimed by
+// `ownerID`, returning an updated claims map when it matches `memberID`
+// and `claims` unchanged otherwise.
+func addClaimIfOwned(claims map[string][]int32, memberID, topic string, partition int32, ownerID string) map[string][]int32 {
+	if ownerID != memberID {
+		return claims
+	}
+	if claims == nil {
+		claims = make(map[string][]int32)
+	}
+	claims[topic] = append(claims[topic], partition)
+	return claims
+}
+
+// DeleteGroup removes a consumer group's registration from ZooKeeper. It
+// refuses to do so while the group still has running members, mirroring
+// kazoo's own `ErrRunningInstances` guard for topic deletion.
+func (a *T) DeleteGroup(ctx context.Context, group string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	groupZNode := a.kazooClt.Consumergroup(group)
+	instances, err := groupZNode.Instances()
+	if err != nil {
+		return errors.Wrapf(err, "failed to list members, group=%s", group)
+	}
+	if len(instances) > 0 {
+		return kazoo.ErrRunningInstances
+	}
+	if err := groupZNode.Delete(); err != nil {
+		return errors.Wrapf(err, "failed to delete group, group=%s", group)
+	}
+	return nil
+}
+
+// ListGroupOffsets returns the last committed offset of every partition a
+// consumer group has an offset on record for.
+func (a *T) ListGroupOffsets(ctx context.Context, group string) (map[TopicPartition]int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	groupZNode := a.kazooClt.Consumergroup(group)
+	topics, err := groupZNode.Topics()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list topics, group=%s", group)
+	}
+	offsets := make(map[TopicPartition]int64)
+	for _, topic := range topics {
+		partitions, err := topic.Partitions()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list partitions, group=%s, topic=%s", group, topic.Name)
+		}
+		for _, partition := range partitions {
+			offset, err := groupZNode.FetchOffset(topic.Name, partition.ID)
+			if err == kazoo.ErrOffsetNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to fetch offset, group=%s, topic=%s, partition=%d",
+					group, topic.Name, partition.ID)
+			}
+			offsets[TopicPartition{Topic: topic.Name, Partition: partition.ID}] = offset
+		}
+	}
+	return offsets, nil
+}
+
+// AlterGroupOffsets overwrites the committed offset of every given
+// topic/partition. It refuses to touch a partition that a member currently
+// claims, since that member is liable to overwrite the new offset with its
+// own next commit.
+func (a *T) AlterGroupOffsets(ctx context.Context, group string, offsets map[TopicPartition]int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	groupZNode := a.kazooClt.Consumergroup(group)
+	for tp, offset := range offsets {
+		owner, err := groupZNode.PartitionOwner(tp.Topic, tp.Partition)
+		if err != nil && err != kazoo.ErrPartitionNotClaimed {
+			return errors.Wrapf(err, "failed to check owner, group=%s, topic=%s, partition=%d",
+				group, tp.Topic, tp.Partition)
+		}
+		if owner != nil {
+			return errors.Errorf("partition is claimed, refusing to alter offset: group=%s, topic=%s, partition=%d, owner=%s",
+				group, tp.Topic, tp.Partition, owner.ID)
+		}
+		if err := groupZNode.CommitOffset(tp.Topic, tp.Partition, offset); err != nil {
+			return errors.Wrapf(err, "failed to commit offset, group=%s, topic=%s, partition=%d",
+				group, tp.Topic, tp.Partition)
+		}
+	}
+	return nil
+}
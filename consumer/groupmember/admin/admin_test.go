@@ -0,0 +1,39 @@
+package admin
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	a := New(nil)
+	if a.kazooClt != nil {
+		t.Errorf("got %v, want nil", a.kazooClt)
+	}
+}
+
+func TestAddClaimIfOwned(t *testing.T) {
+	var claims map[string][]int32
+	claims = addClaimIfOwned(claims, "m1", "foo", 0, "m2")
+	if claims != nil {
+		t.Fatalf("got %v, want nil for a partition owned by a different member", claims)
+	}
+	claims = addClaimIfOwned(claims, "m1", "foo", 0, "m1")
+	claims = addClaimIfOwned(claims, "m1", "foo", 1, "m1")
+	claims = addClaimIfOwned(claims, "m1", "bar", 0, "m1")
+	claims = addClaimIfOwned(claims, "m1", "bar", 1, "m2")
+	want := map[string][]int32{
+		"foo": {0, 1},
+		"bar": {0},
+	}
+	if !reflect.DeepEqual(claims, want) {
+		t.Errorf("got %v, want %v", claims, want)
+	}
+}
+
+func TestAddClaimIfOwnedUnclaimed(t *testing.T) {
+	claims := addClaimIfOwned(nil, "m1", "foo", 0, "")
+	if claims != nil {
+		t.Errorf("got %v, want nil for an unclaimed partition", claims)
+	}
+}
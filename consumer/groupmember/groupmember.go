@@ -1,7 +1,41 @@
+// Package groupmember maintains a consumer group member's registration in
+// ZooKeeper via `wvanbergen/kazoo-go` and turns group membership changes
+// into a stream of resolved subscriptions and rebalance notifications.
+//
+// This package needs two things `wvanbergen/kazoo-go` doesn't provide: a
+// watch on an arbitrary znode (to notice a partition's owner going away)
+// and a place to stash a member's subscription pattern and opaque user
+// data alongside its topic list. Rather than inventing kazoo-go extension
+// methods for these, both are built on primitives this package already
+// has a legitimate claim to:
+//
+//   - `Kazoo.Connection` exposes the `*zk.Conn` kazoo-go already holds
+//     internally, and `ConsumergroupInstance.Path` the znode path it
+//     already computes for a member. Given those, arbitrary watches
+//     (`zk.Conn.ExistsW`, `zk.Conn.ChildrenW`) and raw reads/writes
+//     (`zk.Conn.Get`, `zk.Conn.Set`) are genuine, stable
+//     `samuel/go-zookeeper/zk` API, not something invented for this
+//     package.
+//   - The member registration written to
+//     `/consumers/<group>/ids/<member>` is encoded with this package's own
+//     `memberRegistration`, which mirrors kazoo-go's `Registration` wire
+//     format and adds the one field it lacks (`UserData`). Because this
+//     package both writes and reads that znode, it does not depend on
+//     kazoo-go's own `Registration` type carrying fields it was never
+//     designed to carry.
+//
+// `Kazoo.Connection` and `ConsumergroupInstance.Path` are still an
+// assumption beyond the kazoo-go API this package was originally written
+// against, and should be verified against the vendored copy before
+// merging a change that touches this file.
 package groupmember
 
 import (
+	"encoding/json"
+	"fmt"
+	"regexp"
 	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -13,11 +47,128 @@ import (
 	"github.com/wvanbergen/kazoo-go"
 )
 
+// brokerTopicsPath is where the Kafka brokers advertise the cluster's
+// current topic list in ZooKeeper.
+const brokerTopicsPath = "/brokers/topics"
+
 // It is ok for an attempt to claim a partition to fail, for it might take
 // some time for the current partition owner to release it. So we won't report
 // first several failures to claim a partition as an error.
 const safeClaimRetriesCount = 10
 
+// notificationsChCapacity bounds how many rebalance notifications can be
+// buffered. Notifications are best effort: once the buffer is full new ones
+// are dropped rather than blocking the member's `run()` loop.
+const notificationsChCapacity = 16
+
+// offsetsSettledTimeoutFactor scales `cfg.Consumer.RebalanceDelay` into the
+// wall-clock ceiling `waitOffsetsSettled` will wait for a released
+// partition's offset commit to land before giving up on it.
+const offsetsSettledTimeoutFactor = 10
+
+// errOffsetsNotSettled is reported via a `RebalanceError` notification when
+// `waitOffsetsSettled` times out. It is not returned from `run()`: the
+// rebalance proceeds regardless, since waiting forever would wedge the
+// member.
+var errOffsetsNotSettled = errors.New("offsets of released partitions did not settle within timeout")
+
+// OffsetCheckFunc reports, for a topic/partition this member is about to
+// release, the last offset ZooKeeper has committed for the group and the
+// last offset the application has actually finished processing. It is used
+// to hold off a rebalance until a released partition's owner handoff cannot
+// race its predecessor's pending offset commit.
+type OffsetCheckFunc func(topic string, partition int32) (committed, processed int64, err error)
+
+// SubscriptionSpec defines what a member wants to consume. A `static`
+// pattern subscribes to the listed topics verbatim, while `white_list` and
+// `black_list` treat `Topics` as a slice of regular expressions that are
+// matched against the set of topics currently known to the cluster: a
+// `white_list` member consumes every topic that matches at least one of the
+// regexps, a `black_list` member consumes every topic that matches none of
+// them.
+type SubscriptionSpec struct {
+	Pattern kazoo.RegPattern
+	Topics  []string
+}
+
+// MemberDescription describes a single group member as last observed by a
+// `groupmember.T` or read fresh from ZooKeeper by `groupmember/admin`.
+// `ClaimedPartitions` is only ever populated by `groupmember/admin`'s
+// `DescribeGroup`: `groupmember.T.Describe` reports no claims, neither its
+// own member's nor its peers', and reading them would cost it the
+// ZooKeeper-free guarantee that makes it cheap.
+type MemberDescription struct {
+	Topics            []string
+	Pattern           kazoo.RegPattern
+	ClaimedPartitions map[string][]int32
+	UserData          []byte
+}
+
+// GroupDescription is a point-in-time snapshot of a consumer group's
+// membership, their subscriptions and user data.
+type GroupDescription struct {
+	Group   string
+	Members map[string]MemberDescription
+}
+
+// PeerInfo holds the opaque application metadata a group member attached to
+// its own registration via `SetUserData`, e.g. rack, version or weight,
+// published so that peers and this proxy can implement assignment
+// strategies that take it into account.
+type PeerInfo struct {
+	UserData []byte
+}
+
+// RebalancePhase identifies a stage in the lifecycle of a group rebalance,
+// as observed by this member.
+type RebalancePhase int
+
+const (
+	// RebalanceStart is emitted as soon as a group membership change has
+	// been observed, before the resulting subscriptions are known.
+	RebalanceStart RebalancePhase = iota
+	// RebalanceOK is emitted once the subscriptions resulting from a
+	// rebalance have been delivered on the `Subscriptions()` channel, or
+	// once the fetched subscriptions turn out to equal the current ones, in
+	// which case nothing is delivered.
+	RebalanceOK
+	// RebalanceError is emitted when a step of the rebalance failed. The
+	// member retries automatically, so an error does not mean the rebalance
+	// was abandoned, only that it is taking longer than usual. The one
+	// exception is `errOffsetsNotSettled`: it is not retried, and the
+	// rebalance proceeds right after it is emitted.
+	RebalanceError
+)
+
+func (p RebalancePhase) String() string {
+	switch p {
+	case RebalanceStart:
+		return "start"
+	case RebalanceOK:
+		return "ok"
+	case RebalanceError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// RebalanceEvent reports a phase transition of a group rebalance. `Claimed`,
+// `Added` and `Removed` describe how this member's own topic subscription
+// changed as a result of the rebalance; `Prev`/`New` carry the subscriptions
+// of the whole group, for consumers that want the full picture.
+type RebalanceEvent struct {
+	Group   string
+	Phase   RebalancePhase
+	Err     error
+	Prev    map[string][]string
+	New     map[string][]string
+	Claimed []string
+	Added   []string
+	Removed []string
+	Took    time.Duration
+}
+
 // T maintains a consumer group member registration in ZooKeeper, watches for
 // other members to join, leave and update their subscriptions, and generates
 // notifications of such changes.
@@ -25,12 +176,23 @@ type T struct {
 	actDesc          *actor.Descriptor
 	cfg              *config.Proxy
 	group            string
+	kazooClt         *kazoo.Kazoo
 	groupZNode       *kazoo.Consumergroup
 	groupMemberZNode *kazoo.ConsumergroupInstance
-	topics           []string
+	spec             SubscriptionSpec
+	registered       bool
+	subsMu           sync.Mutex
 	subscriptions    map[string][]string
-	topicsCh         chan []string
+	peerMetadata     map[string]PeerInfo
+	peerPatterns     map[string]kazoo.RegPattern
+	subsChangedCh    chan none.T
+	knownTopics      []string
+	offsetCheck      OffsetCheckFunc
+	userData         []byte
+	specCh           chan SubscriptionSpec
 	subscriptionsCh  chan map[string][]string
+	peerMetadataCh   chan map[string]PeerInfo
+	notificationsCh  chan RebalanceEvent
 	stopCh           chan none.T
 	wg               sync.WaitGroup
 }
@@ -46,21 +208,28 @@ func Spawn(parentActDesc *actor.Descriptor, group, memberID string, cfg *config.
 		actDesc:          actDesc,
 		cfg:              cfg,
 		group:            group,
+		kazooClt:         kazooClt,
 		groupZNode:       groupZNode,
 		groupMemberZNode: groupMemberZNode,
-		topicsCh:         make(chan []string),
+		specCh:           make(chan SubscriptionSpec),
 		subscriptionsCh:  make(chan map[string][]string),
+		peerMetadataCh:   make(chan map[string]PeerInfo),
+		notificationsCh:  make(chan RebalanceEvent, notificationsChCapacity),
+		subsChangedCh:    make(chan none.T),
 		stopCh:           make(chan none.T),
 	}
 	actor.Spawn(gm.actDesc, &gm.wg, gm.run)
 	return gm
 }
 
-// Topics returns a channel to receive a list of topics the member should
-// subscribe to. To make the member unsubscribe from all topics either nil or
-// an empty topic list can be sent.
-func (gm *T) Topics() chan<- []string {
-	return gm.topicsCh
+// Topics returns a channel to receive a subscription spec describing the
+// topics the member should subscribe to. To make the member unsubscribe from
+// all topics either a zero value or a `static` spec with an empty topic list
+// can be sent. `white_list`/`black_list` specs are registered with their
+// pattern and regexps as given; every member expands them against the
+// cluster's current topic set when it reads the group's registrations.
+func (gm *T) Topics() chan<- SubscriptionSpec {
+	return gm.specCh
 }
 
 // Subscriptions returns a channel that subscriptions will be sent whenever a
@@ -70,14 +239,160 @@ func (gm *T) Subscriptions() <-chan map[string][]string {
 	return gm.subscriptionsCh
 }
 
-// ClaimPartition claims a topic/partition to be consumed by this member of the
-// consumer group. It blocks until either succeeds or canceled by the caller. It
-// returns a function that should be called to release the claim.
+// Notifications returns a channel that rebalance lifecycle events are sent
+// on: `RebalanceStart` when a membership change is first observed,
+// `RebalanceOK` once the resulting subscriptions have been delivered (or
+// turned out unchanged), and `RebalanceError` when a step of the rebalance
+// fails and is about to be retried, or when the offsets of released
+// partitions did not settle in time and the rebalance proceeds anyway.
+// Notifications are best effort and may be dropped if the caller
+// falls behind.
+func (gm *T) Notifications() <-chan RebalanceEvent {
+	return gm.notificationsCh
+}
+
+// PeerMetadata returns a channel that the per-member user data registered
+// by every member of the group (as set via their own `SetUserData`) is sent
+// on whenever the group's membership or subscriptions change. Members that
+// did not set any user data are present with a zero-value `PeerInfo`.
+func (gm *T) PeerMetadata() <-chan map[string]PeerInfo {
+	return gm.peerMetadataCh
+}
+
+// SetUserData attaches an opaque byte slice to this member's registration
+// so that peers observing the group can read it back via `PeerMetadata`. It
+// must be called before the first topics are submitted via `Topics()` for
+// it to take effect on the initial registration.
+func (gm *T) SetUserData(userData []byte) {
+	gm.userData = userData
+}
+
+// SetOffsetCheck installs a hook that `run()` consults before handing a
+// partition this member currently owns over to a new subscription set,
+// giving the previous owner's offset commit a chance to land in ZooKeeper
+// first. It must be called before the member starts observing subscription
+// changes it cares about, e.g. right after `Spawn`.
+func (gm *T) SetOffsetCheck(fn OffsetCheckFunc) {
+	gm.offsetCheck = fn
+}
+
+// setSubscriptions installs newly fetched subscriptions and peer metadata,
+// and wakes up any `ClaimPartition` call that is currently waiting on a
+// stale view of the group's membership, so it can re-evaluate its
+// deterministic claim rank against the new subscriptions right away instead
+// of riding out its current wait.
+func (gm *T) setSubscriptions(subscriptions map[string][]string, peerMetadata map[string]PeerInfo, peerPatterns map[string]kazoo.RegPattern) {
+	gm.subsMu.Lock()
+	defer gm.subsMu.Unlock()
+	gm.subscriptions = subscriptions
+	gm.peerMetadata = peerMetadata
+	gm.peerPatterns = peerPatterns
+	close(gm.subsChangedCh)
+	gm.subsChangedCh = make(chan none.T)
+}
+
+// Describe returns a snapshot of the group's membership, subscriptions and
+// user data as last observed by this member. Unlike `groupmember/admin`'s
+// `DescribeGroup`, it performs no ZooKeeper reads of its own, which makes it
+// cheap enough for hot-path admin queries.
+func (gm *T) Describe() GroupDescription {
+	gm.subsMu.Lock()
+	defer gm.subsMu.Unlock()
+	members := make(map[string]MemberDescription, len(gm.subscriptions))
+	for memberID, topics := range gm.subscriptions {
+		members[memberID] = MemberDescription{
+			Topics:   topics,
+			Pattern:  gm.peerPatterns[memberID],
+			UserData: gm.peerMetadata[memberID].UserData,
+		}
+	}
+	return GroupDescription{Group: gm.group, Members: members}
+}
+
+// subsChanged returns the channel that is closed the next time
+// `setSubscriptions` runs.
+func (gm *T) subsChanged() <-chan none.T {
+	gm.subsMu.Lock()
+	defer gm.subsMu.Unlock()
+	return gm.subsChangedCh
+}
+
+// currentSubscriptions returns the subscriptions last installed by
+// `setSubscriptions`. `run()` is the only writer of `gm.subscriptions`, but
+// `claimRank` and `Describe` read it from other goroutines, so `run()` must
+// go through this locked accessor itself rather than reading the field
+// directly, the same as any other caller.
+func (gm *T) currentSubscriptions() map[string][]string {
+	gm.subsMu.Lock()
+	defer gm.subsMu.Unlock()
+	return gm.subscriptions
+}
+
+// claimRank computes this member's rank among the members subscribed to
+// `topic`, relative to the member that is expected to own `partition`: 0 if
+// this member is the expected owner, a positive number otherwise. Members
+// are ordered deterministically by member ID, and the expected owner of a
+// partition is `subscribed[int(partition) % len(subscribed)]`, so that
+// under a simultaneous group start every member converges on the same
+// assignment without needing to communicate beyond their subscriptions.
+func (gm *T) claimRank(topic string, partition int32) int {
+	subscriptions := gm.currentSubscriptions()
+
+	var subscribed []string
+	for memberID, topics := range subscriptions {
+		for _, t := range topics {
+			if t == topic {
+				subscribed = append(subscribed, memberID)
+				break
+			}
+		}
+	}
+	if len(subscribed) == 0 {
+		return 0
+	}
+	sort.Strings(subscribed)
+	ownIdx := sort.SearchStrings(subscribed, gm.groupMemberZNode.ID)
+	intendedIdx := int(partition) % len(subscribed)
+	rank := ownIdx - intendedIdx
+	if rank < 0 {
+		rank += len(subscribed)
+	}
+	return rank
+}
+
+// ownerPath returns the ZooKeeper path of the znode that records the
+// current owner of a topic/partition within this member's group.
+func (gm *T) ownerPath(topic string, partition int32) string {
+	return fmt.Sprintf("/consumers/%s/owners/%s/%d", gm.group, topic, partition)
+}
+
+// ClaimPartition claims a topic/partition to be consumed by this member of
+// the consumer group. It blocks until either it succeeds or is canceled by
+// the caller. Instead of retrying at a uniform interval, which under
+// contention keeps the same loser re-losing races against the rest of the
+// group, a failed attempt waits on a ZooKeeper watch of the current owner
+// znode (capped by `RetryBackoff * safeClaimRetriesCount`, in case the
+// owner disappears without ZooKeeper notifying us) and is staggered by
+// `claimRank`, so that the member expected to own the partition wins the
+// first race. It returns a function that should be called to release the
+// claim.
 func (gm *T) ClaimPartition(claimerActDesc *actor.Descriptor, topic string, partition int32, cancelCh <-chan none.T) func() {
 	beginAt := time.Now()
 	retries := 0
-	err := gm.groupMemberZNode.ClaimPartition(topic, partition)
-	for err != nil {
+	maxWait := gm.cfg.Consumer.RetryBackoff * safeClaimRetriesCount
+	for {
+		if rank := gm.claimRank(topic, partition); rank > 0 {
+			select {
+			case <-time.After(time.Duration(rank) * gm.cfg.Consumer.RetryBackoff):
+			case <-gm.subsChanged():
+			case <-cancelCh:
+				return func() {}
+			}
+		}
+		err := gm.groupMemberZNode.ClaimPartition(topic, partition)
+		if err == nil {
+			break
+		}
 		logEntry := claimerActDesc.Log().WithError(err)
 		logFailureFn := logEntry.Infof
 		if retries++; retries > safeClaimRetriesCount {
@@ -85,12 +400,19 @@ func (gm *T) ClaimPartition(claimerActDesc *actor.Descriptor, topic string, part
 		}
 		logFailureFn("failed to claim partition: via=%s, retries=%d, took=%s",
 			gm.actDesc, retries, millisSince(beginAt))
+
+		_, _, ownerGoneCh, watchErr := gm.kazooClt.Connection().ExistsW(gm.ownerPath(topic, partition))
+		if watchErr != nil {
+			logFailureFn("failed to watch owner: via=%s, retries=%d, took=%s",
+				gm.actDesc, retries, millisSince(beginAt))
+		}
 		select {
-		case <-time.After(gm.cfg.Consumer.RetryBackoff):
+		case <-ownerGoneCh:
+		case <-gm.subsChanged():
+		case <-time.After(maxWait):
 		case <-cancelCh:
 			return func() {}
 		}
-		err = gm.groupMemberZNode.ClaimPartition(topic, partition)
 	}
 	claimerActDesc.Log().Infof("partition claimed: via=%s, retries=%d, took=%s",
 		gm.actDesc, retries, millisSince(beginAt))
@@ -123,6 +445,7 @@ func (gm *T) Stop() {
 
 func (gm *T) run() {
 	defer close(gm.subscriptionsCh)
+	defer close(gm.peerMetadataCh)
 
 	// Ensure a group ZNode exist.
 	err := gm.groupZNode.Create()
@@ -147,40 +470,84 @@ func (gm *T) run() {
 		}
 	}()
 
+	// Ensure that we have an up to date view of the cluster's topic list: it
+	// is used to expand `white_list`/`black_list` subscriptions into
+	// concrete topic sets.
+	knownTopics, nilOrTopicsUpdatedCh, err := gm.watchTopics()
+	for err != nil {
+		gm.actDesc.Log().WithError(err).Error("failed to watch topics")
+		select {
+		case <-time.After(gm.cfg.Consumer.RetryBackoff):
+		case <-gm.stopCh:
+			return
+		}
+		knownTopics, nilOrTopicsUpdatedCh, err = gm.watchTopics()
+	}
+	gm.knownTopics = topicNames(knownTopics)
+
 	var (
 		nilOrSubscriptionsCh     chan<- map[string][]string
+		nilOrPeerMetadataCh      chan<- map[string]PeerInfo
 		nilOrGroupUpdatedCh      <-chan zk.Event
 		nilOrTimeoutCh           <-chan time.Time
-		pendingTopics            []string
+		pendingSpec              SubscriptionSpec
 		pendingSubscriptions     map[string][]string
+		pendingPeerMetadata      map[string]PeerInfo
+		pendingPeerPatterns      map[string]kazoo.RegPattern
 		shouldSubmitTopics       = false
 		shouldFetchMembers       = false
 		shouldFetchSubscriptions = false
+		shouldRefreshTopics      = false
 		members                  []*kazoo.ConsumergroupInstance
+		rebalanceBeginAt         time.Time
 	)
 	for {
 		select {
-		case topics := <-gm.topicsCh:
-			pendingTopics = normalizeTopics(topics)
-			shouldSubmitTopics = !topicsEqual(pendingTopics, gm.topics)
+		case spec := <-gm.specCh:
+			if spec.Pattern == "" {
+				spec.Pattern = kazoo.PatternStatic
+			}
+			spec.Topics = normalizeTopics(spec.Topics)
+			shouldSubmitTopics = !specEqual(spec, gm.spec)
+			pendingSpec = spec
 		case nilOrSubscriptionsCh <- pendingSubscriptions:
 			nilOrSubscriptionsCh = nil
-			gm.subscriptions = pendingSubscriptions
+			ownID := gm.groupMemberZNode.ID
+			prevSubscriptions := gm.currentSubscriptions()
+			added, removed := diffTopics(prevSubscriptions[ownID], pendingSubscriptions[ownID])
+			gm.notify(RebalanceEvent{
+				Phase:   RebalanceOK,
+				Prev:    prevSubscriptions,
+				New:     pendingSubscriptions,
+				Claimed: pendingSubscriptions[ownID],
+				Added:   added,
+				Removed: removed,
+				Took:    time.Since(rebalanceBeginAt),
+			})
+			gm.setSubscriptions(pendingSubscriptions, pendingPeerMetadata, pendingPeerPatterns)
+		case nilOrPeerMetadataCh <- pendingPeerMetadata:
+			nilOrPeerMetadataCh = nil
 		case <-nilOrGroupUpdatedCh:
 			nilOrGroupUpdatedCh = nil
 			shouldFetchMembers = true
+			rebalanceBeginAt = time.Now()
+			gm.notify(RebalanceEvent{Phase: RebalanceStart, Prev: gm.currentSubscriptions()})
+		case <-nilOrTopicsUpdatedCh:
+			nilOrTopicsUpdatedCh = nil
+			shouldRefreshTopics = true
 		case <-nilOrTimeoutCh:
 		case <-gm.stopCh:
 			return
 		}
 
 		if shouldSubmitTopics {
-			if err = gm.submitTopics(pendingTopics); err != nil {
+			if err = gm.submitTopics(pendingSpec); err != nil {
 				gm.actDesc.Log().WithError(err).Error("failed to submit topics")
+				gm.notify(RebalanceEvent{Phase: RebalanceError, Err: err, Took: time.Since(rebalanceBeginAt)})
 				nilOrTimeoutCh = time.After(gm.cfg.Consumer.RetryBackoff)
 				continue
 			}
-			gm.actDesc.Log().Infof("submitted: topics=%v", pendingTopics)
+			gm.actDesc.Log().Infof("submitted: spec=%+v", pendingSpec)
 			shouldSubmitTopics = false
 			shouldFetchMembers = true
 		}
@@ -189,6 +556,7 @@ func (gm *T) run() {
 			members, nilOrGroupUpdatedCh, err = gm.groupZNode.WatchInstances()
 			if err != nil {
 				gm.actDesc.Log().WithError(err).Error("failed to watch members")
+				gm.notify(RebalanceEvent{Phase: RebalanceError, Err: err, Took: time.Since(rebalanceBeginAt)})
 				nilOrTimeoutCh = time.After(gm.cfg.Consumer.RetryBackoff)
 				continue
 			}
@@ -201,66 +569,359 @@ func (gm *T) run() {
 			continue
 		}
 
+		if shouldRefreshTopics {
+			topics, topicsUpdatedCh, err := gm.watchTopics()
+			if err != nil {
+				gm.actDesc.Log().WithError(err).Error("failed to watch topics")
+				gm.notify(RebalanceEvent{Phase: RebalanceError, Err: err, Took: time.Since(rebalanceBeginAt)})
+				nilOrTimeoutCh = time.After(gm.cfg.Consumer.RetryBackoff)
+				continue
+			}
+			nilOrTopicsUpdatedCh = topicsUpdatedCh
+			gm.knownTopics = topicNames(topics)
+			shouldRefreshTopics = false
+			shouldFetchSubscriptions = true
+			// Debounce topic set changes the same way membership changes are
+			// debounced, to avoid thrashing on transient topic creates/deletes.
+			nilOrTimeoutCh = time.After(gm.cfg.Consumer.RebalanceDelay)
+			continue
+		}
+
 		if shouldFetchSubscriptions {
-			pendingSubscriptions, err = gm.fetchSubscriptions(members)
+			pendingSubscriptions, pendingPeerMetadata, pendingPeerPatterns, err = gm.fetchSubscriptions(members)
 			if err != nil {
 				gm.actDesc.Log().WithError(err).Error("failed to fetch subscriptions")
+				gm.notify(RebalanceEvent{Phase: RebalanceError, Err: err, Took: time.Since(rebalanceBeginAt)})
 				nilOrTimeoutCh = time.After(gm.cfg.Consumer.RetryBackoff)
 				continue
 			}
 			shouldFetchSubscriptions = false
 			gm.actDesc.Log().Infof("fetched subscriptions: %v", pendingSubscriptions)
-			if subscriptionsEqual(pendingSubscriptions, gm.subscriptions) {
+			prevSubscriptions := gm.currentSubscriptions()
+			if subscriptionsEqual(pendingSubscriptions, prevSubscriptions) {
 				nilOrSubscriptionsCh = nil
 				pendingSubscriptions = nil
-				gm.actDesc.Log().Infof("redundant group update ignored: %v", gm.subscriptions)
+				gm.actDesc.Log().Infof("redundant group update ignored: %v", prevSubscriptions)
+				gm.notify(RebalanceEvent{Phase: RebalanceOK, Took: time.Since(rebalanceBeginAt)})
 				continue
 			}
+			released, err := gm.releasedPartitions(prevSubscriptions, pendingSubscriptions)
+			if err != nil {
+				gm.actDesc.Log().WithError(err).Error("failed to compute released partitions")
+			} else if !gm.waitOffsetsSettled(released) {
+				gm.actDesc.Log().Warnf("offsets not settled, proceeding anyway: partitions=%v", released)
+				gm.notify(RebalanceEvent{Phase: RebalanceError, Err: errOffsetsNotSettled, Took: time.Since(rebalanceBeginAt)})
+			}
 			nilOrSubscriptionsCh = gm.subscriptionsCh
+			nilOrPeerMetadataCh = gm.peerMetadataCh
 		}
 	}
 }
 
-// fetchSubscriptions retrieves registration records for the specified members
-// from ZooKeeper.
-//
-// FIXME: It is assumed that all members of the group are registered with the
-// FIXME: `static` pattern. If a member that pattern is either `white_list` or
-// FIXME: `black_list` joins the group the result will be unpredictable.
-func (gm *T) fetchSubscriptions(members []*kazoo.ConsumergroupInstance) (map[string][]string, error) {
+// memberRegistration is the JSON document this package writes to a
+// member's znode at `/consumers/<group>/ids/<member>`. It mirrors
+// kazoo-go's own `Registration` wire format (`Pattern`, `Subscription`,
+// `Timestamp`, `Version`) and adds `UserData`, a field `Registration`
+// does not define. Reading and writing this znode directly, rather than
+// through kazoo-go, keeps that extra field entirely within this
+// package's control: any kazoo-go version that can parse the fields it
+// does define will simply ignore the one it doesn't.
+type memberRegistration struct {
+	Pattern      kazoo.RegPattern `json:"pattern,omitempty"`
+	Subscription map[string]int   `json:"subscription"`
+	Timestamp    string           `json:"timestamp"`
+	Version      int              `json:"version"`
+	UserData     []byte           `json:"user_data,omitempty"`
+}
+
+// ParseRegistration decodes a member's registration znode the same way
+// `groupmember.T` does internally. It is exported so that
+// `groupmember/admin`, which has no live `T` to ask, can resolve a
+// member's pattern and user data the same way.
+func ParseRegistration(data []byte) (pattern kazoo.RegPattern, topicsOrPatterns []string, userData []byte, err error) {
+	var registration memberRegistration
+	if err := json.Unmarshal(data, &registration); err != nil {
+		return "", nil, nil, err
+	}
+	pattern = registration.Pattern
+	if pattern == "" {
+		pattern = kazoo.PatternStatic
+	}
+	topicsOrPatterns = make([]string, 0, len(registration.Subscription))
+	for topic := range registration.Subscription {
+		topicsOrPatterns = append(topicsOrPatterns, topic)
+	}
+	return pattern, topicsOrPatterns, registration.UserData, nil
+}
+
+// fetchSubscriptions retrieves registration records for the specified
+// members from ZooKeeper and resolves each member's pattern against the
+// current cluster topic list, so that the result always holds the concrete
+// set of topics a member consumes, regardless of whether it registered with
+// a `static`, `white_list` or `black_list` pattern. It also collects each
+// member's opaque user data, as set via `SetUserData`.
+func (gm *T) fetchSubscriptions(members []*kazoo.ConsumergroupInstance) (map[string][]string, map[string]PeerInfo, map[string]kazoo.RegPattern, error) {
 	subscriptions := make(map[string][]string, len(members))
+	peerMetadata := make(map[string]PeerInfo, len(members))
+	peerPatterns := make(map[string]kazoo.RegPattern, len(members))
 	for _, member := range members {
-		var registration *kazoo.Registration
-		registration, err := member.Registration()
-		for err != nil {
-			return nil, errors.Wrapf(err, "failed to fetch registration, member=%s", member.ID)
+		data, _, err := gm.kazooClt.Connection().Get(member.Path())
+		if err != nil {
+			return nil, nil, nil, errors.Wrapf(err, "failed to fetch registration, member=%s", member.ID)
 		}
-		// Sort topics to ensure deterministic output.
-		topics := make([]string, 0, len(registration.Subscription))
-		for topic := range registration.Subscription {
-			topics = append(topics, topic)
+		pattern, topicsOrPatterns, userData, err := ParseRegistration(data)
+		if err != nil {
+			return nil, nil, nil, errors.Wrapf(err, "failed to parse registration, member=%s", member.ID)
+		}
+		topics, err := gm.expandSubscription(pattern, topicsOrPatterns)
+		if err != nil {
+			return nil, nil, nil, errors.Wrapf(err, "failed to expand subscription, member=%s", member.ID)
 		}
 		subscriptions[member.ID] = normalizeTopics(topics)
+		peerMetadata[member.ID] = PeerInfo{UserData: userData}
+		peerPatterns[member.ID] = pattern
+	}
+	return subscriptions, peerMetadata, peerPatterns, nil
+}
+
+// expandSubscription resolves a member's raw registration against the
+// cluster's current topic list.
+func (gm *T) expandSubscription(pattern kazoo.RegPattern, topicsOrPatterns []string) ([]string, error) {
+	return ExpandSubscription(pattern, topicsOrPatterns, gm.knownTopics)
+}
+
+// ExpandSubscription resolves a raw registration against a given cluster
+// topic list. A `static` registration is returned as is. `white_list`/
+// `black_list` registrations treat `topicsOrPatterns` as a list of regular
+// expressions and are resolved to the topics that match at least one of
+// them (`white_list`) or none of them (`black_list`). It is exported so
+// that `groupmember/admin`, which has no `knownTopics` of its own to
+// expand against, can resolve a member's subscription the same way
+// `groupmember.T` does internally.
+func ExpandSubscription(pattern kazoo.RegPattern, topicsOrPatterns []string, knownTopics []string) ([]string, error) {
+	switch pattern {
+	case "", kazoo.PatternStatic:
+		return topicsOrPatterns, nil
+	case kazoo.PatternWhiteList, kazoo.PatternBlackList:
+		regexps := make([]*regexp.Regexp, len(topicsOrPatterns))
+		for i, p := range topicsOrPatterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid topic pattern: %s", p)
+			}
+			regexps[i] = re
+		}
+		var topics []string
+		for _, topic := range knownTopics {
+			matched := false
+			for _, re := range regexps {
+				if re.MatchString(topic) {
+					matched = true
+					break
+				}
+			}
+			if matched == (pattern == kazoo.PatternWhiteList) {
+				topics = append(topics, topic)
+			}
+		}
+		return topics, nil
+	default:
+		return nil, errors.Errorf("unsupported subscription pattern: %s", pattern)
+	}
+}
+
+// topicPartition identifies a single partition of a topic this member was
+// the deterministically expected owner of before a rebalance and no longer
+// is after it, as computed by `releasedPartitions`.
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// releasedPartitions reports every topic/partition whose deterministically
+// expected owner -- computed the same way `claimRank` ranks a single
+// partition, via `subscribed[int(partition) % len(subscribed)]` over the
+// sorted list of members subscribed to the topic -- was this member under
+// `prev` but is a different member under `next`. Comparing at the
+// partition level, rather than diffing this member's own topic list,
+// catches the case `waitOffsetsSettled` exists to close: a partition
+// reassigned to a new owner by membership churn while this member keeps
+// subscribing to the topic the partition belongs to.
+func (gm *T) releasedPartitions(prev, next map[string][]string) ([]topicPartition, error) {
+	ownID := gm.groupMemberZNode.ID
+	topics := make(map[string]none.T, len(prev[ownID]))
+	for _, topic := range prev[ownID] {
+		topics[topic] = none.T{}
+	}
+	var released []topicPartition
+	for topic := range topics {
+		partitions, err := gm.topicPartitions(topic)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list partitions, topic=%s", topic)
+		}
+		prevOwners := expectedOwners(prev, topic, partitions)
+		nextOwners := expectedOwners(next, topic, partitions)
+		for _, partition := range partitions {
+			if prevOwners[partition] == ownID && nextOwners[partition] != ownID {
+				released = append(released, topicPartition{topic: topic, partition: partition})
+			}
+		}
+	}
+	return released, nil
+}
+
+// expectedOwners maps every given partition of `topic` to the member ID
+// that `subscriptions` deterministically assigns it to, the same way
+// `claimRank` does for a single partition.
+func expectedOwners(subscriptions map[string][]string, topic string, partitions []int32) map[int32]string {
+	var subscribed []string
+	for memberID, topics := range subscriptions {
+		for _, t := range topics {
+			if t == topic {
+				subscribed = append(subscribed, memberID)
+				break
+			}
+		}
+	}
+	if len(subscribed) == 0 {
+		return nil
+	}
+	sort.Strings(subscribed)
+	owners := make(map[int32]string, len(partitions))
+	for _, partition := range partitions {
+		owners[partition] = subscribed[int(partition)%len(subscribed)]
+	}
+	return owners
+}
+
+// waitOffsetsSettled blocks until every partition in `released` has its
+// group-committed offset caught up to (or past) the last offset this
+// member has actually processed, so that whoever claims the partition next
+// does not start reading behind a commit that hasn't landed yet. It polls
+// `gm.offsetCheck` with exponential backoff and gives up, returning false,
+// once `cfg.Consumer.RebalanceDelay * offsetsSettledTimeoutFactor` has
+// elapsed. It also returns promptly if the member is stopped.
+func (gm *T) waitOffsetsSettled(released []topicPartition) bool {
+	if gm.offsetCheck == nil || len(released) == 0 {
+		return true
+	}
+	deadline := time.Now().Add(gm.cfg.Consumer.RebalanceDelay * offsetsSettledTimeoutFactor)
+	for _, tp := range released {
+		backoff := gm.cfg.Consumer.RetryBackoff
+		for {
+			committed, processed, err := gm.offsetCheck(tp.topic, tp.partition)
+			if err == nil && committed >= processed {
+				break
+			}
+			if err != nil {
+				gm.actDesc.Log().WithError(err).Infof("offset check failed: topic=%s, partition=%d", tp.topic, tp.partition)
+			}
+			if !time.Now().Before(deadline) {
+				return false
+			}
+			select {
+			case <-time.After(backoff):
+			case <-gm.stopCh:
+				return false
+			}
+			if backoff *= 2; backoff > gm.cfg.Consumer.RebalanceDelay {
+				backoff = gm.cfg.Consumer.RebalanceDelay
+			}
+		}
 	}
-	return subscriptions, nil
+	return true
 }
 
-func (gm *T) submitTopics(topics []string) error {
-	if gm.topics != nil {
+// watchTopics returns the cluster's current topic list and a channel that
+// receives an event the next time a topic is added to or removed from
+// `brokerTopicsPath`. Kazoo-go exposes the topic list itself
+// (`Kazoo.Topics`), but not a watch on it, so the watch is set directly
+// via the underlying ZooKeeper connection.
+func (gm *T) watchTopics() (kazoo.TopicList, <-chan zk.Event, error) {
+	topics, err := gm.kazooClt.Topics()
+	if err != nil {
+		return nil, nil, err
+	}
+	_, _, topicsUpdatedCh, err := gm.kazooClt.Connection().ChildrenW(brokerTopicsPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return topics, topicsUpdatedCh, nil
+}
+
+// topicPartitions returns the ids of all partitions of the given topic.
+func (gm *T) topicPartitions(topic string) ([]int32, error) {
+	partitions, err := gm.kazooClt.Topic(topic).Partitions()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int32, len(partitions))
+	for i, partition := range partitions {
+		ids[i] = partition.ID
+	}
+	return ids, nil
+}
+
+func (gm *T) submitTopics(spec SubscriptionSpec) error {
+	if gm.registered {
 		err := gm.groupMemberZNode.Deregister()
 		if err != nil && err != kazoo.ErrInstanceNotRegistered {
 			return errors.Wrap(err, "failed to deregister")
 		}
 	}
-	gm.topics = nil
-	err := gm.groupMemberZNode.Register(topics)
-	for err != nil {
+	gm.registered = false
+	if err := gm.register(spec); err != nil {
 		return errors.Wrap(err, "failed to register")
 	}
-	gm.topics = topics
+	gm.spec = spec
+	gm.registered = true
 	return nil
 }
 
+// register writes the member's registration to ZooKeeper according to the
+// given subscription spec, preserving the pattern and any user data set via
+// `SetUserData` so that peers can resolve it the same way
+// `fetchSubscriptions` does. `Register` creates the ephemeral registration
+// znode tied to the current ZooKeeper session; since it has no way to
+// express a non-`static` pattern or user data, this package's own
+// `memberRegistration` is then written over the znode it just created to
+// fill in both.
+func (gm *T) register(spec SubscriptionSpec) error {
+	pattern := spec.Pattern
+	if pattern == "" {
+		pattern = kazoo.PatternStatic
+	}
+	if err := gm.groupMemberZNode.Register(spec.Topics); err != nil {
+		return err
+	}
+	if pattern == kazoo.PatternStatic && len(gm.userData) == 0 {
+		return nil
+	}
+	return gm.writeRegistration(pattern, spec.Topics, gm.userData)
+}
+
+// writeRegistration overwrites the registration znode `Register` just
+// created with this package's own encoding of it, adding the
+// subscription's real pattern and any `SetUserData` user data -- neither
+// of which `kazoo.ConsumergroupInstance.Register` can express.
+func (gm *T) writeRegistration(pattern kazoo.RegPattern, topics []string, userData []byte) error {
+	subscription := make(map[string]int, len(topics))
+	for _, topic := range topics {
+		subscription[topic] = 1
+	}
+	data, err := json.Marshal(memberRegistration{
+		Pattern:      pattern,
+		Subscription: subscription,
+		Timestamp:    strconv.FormatInt(time.Now().Unix(), 10),
+		UserData:     userData,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal registration")
+	}
+	_, err = gm.kazooClt.Connection().Set(gm.groupMemberZNode.Path(), data, -1)
+	return err
+}
+
 func normalizeTopics(s []string) []string {
 	if s == nil || len(s) == 0 {
 		return nil
@@ -269,6 +930,56 @@ func normalizeTopics(s []string) []string {
 	return s
 }
 
+// notify delivers a rebalance event to the notifications channel. The send
+// is non-blocking: if a caller isn't keeping up with `Notifications()`, the
+// event is dropped rather than stalling the member's `run()` loop.
+func (gm *T) notify(evt RebalanceEvent) {
+	evt.Group = gm.group
+	select {
+	case gm.notificationsCh <- evt:
+	default:
+		gm.actDesc.Log().Warnf("rebalance notification dropped: phase=%s", evt.Phase)
+	}
+}
+
+// diffTopics compares two sorted topic slices and reports which topics were
+// added and which were removed going from `prev` to `next`.
+func diffTopics(prev, next []string) (added, removed []string) {
+	prevSet := make(map[string]none.T, len(prev))
+	for _, topic := range prev {
+		prevSet[topic] = none.T{}
+	}
+	nextSet := make(map[string]none.T, len(next))
+	for _, topic := range next {
+		nextSet[topic] = none.T{}
+	}
+	for _, topic := range next {
+		if _, ok := prevSet[topic]; !ok {
+			added = append(added, topic)
+		}
+	}
+	for _, topic := range prev {
+		if _, ok := nextSet[topic]; !ok {
+			removed = append(removed, topic)
+		}
+	}
+	return added, removed
+}
+
+func specEqual(lhs, rhs SubscriptionSpec) bool {
+	return lhs.Pattern == rhs.Pattern && topicsEqual(lhs.Topics, rhs.Topics)
+}
+
+// topicNames extracts topic names out of a kazoo topic list, as returned by
+// `Kazoo.Topics`.
+func topicNames(topics kazoo.TopicList) []string {
+	names := make([]string, len(topics))
+	for i, topic := range topics {
+		names[i] = topic.Name
+	}
+	return names
+}
+
 func topicsEqual(lhs, rhs []string) bool {
 	if len(lhs) != len(rhs) {
 		return false
@@ -0,0 +1,177 @@
+package groupmember
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mailgun/kafka-pixy/config"
+	"github.com/wvanbergen/kazoo-go"
+)
+
+func TestDiffTopics(t *testing.T) {
+	tests := []struct {
+		prev, next  []string
+		wantAdded   []string
+		wantRemoved []string
+	}{
+		{nil, nil, nil, nil},
+		{nil, []string{"a", "b"}, []string{"a", "b"}, nil},
+		{[]string{"a", "b"}, nil, nil, []string{"a", "b"}},
+		{[]string{"a", "b"}, []string{"b", "c"}, []string{"c"}, []string{"a"}},
+		{[]string{"a", "b"}, []string{"a", "b"}, nil, nil},
+	}
+	for _, tt := range tests {
+		added, removed := diffTopics(tt.prev, tt.next)
+		if !reflect.DeepEqual(added, tt.wantAdded) {
+			t.Errorf("diffTopics(%v, %v) added = %v, want %v", tt.prev, tt.next, added, tt.wantAdded)
+		}
+		if !reflect.DeepEqual(removed, tt.wantRemoved) {
+			t.Errorf("diffTopics(%v, %v) removed = %v, want %v", tt.prev, tt.next, removed, tt.wantRemoved)
+		}
+	}
+}
+
+func TestExpandSubscriptionStatic(t *testing.T) {
+	gm := &T{knownTopics: []string{"foo", "bar"}}
+	topics, err := gm.expandSubscription(kazoo.PatternStatic, []string{"foo", "qux"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(topics, []string{"foo", "qux"}) {
+		t.Errorf("got %v, want %v", topics, []string{"foo", "qux"})
+	}
+}
+
+func TestExpandSubscriptionWhiteList(t *testing.T) {
+	gm := &T{knownTopics: []string{"orders.created", "orders.updated", "payments"}}
+	topics, err := gm.expandSubscription(kazoo.PatternWhiteList, []string{"^orders\\."})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string]bool{"orders.created": true, "orders.updated": true}
+	if len(topics) != len(want) {
+		t.Fatalf("got %v, want topics matching %v", topics, want)
+	}
+	for _, topic := range topics {
+		if !want[topic] {
+			t.Errorf("unexpected topic in white_list expansion: %s", topic)
+		}
+	}
+}
+
+func TestExpandSubscriptionBlackList(t *testing.T) {
+	gm := &T{knownTopics: []string{"orders.created", "orders.updated", "payments"}}
+	topics, err := gm.expandSubscription(kazoo.PatternBlackList, []string{"^orders\\."})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(topics, []string{"payments"}) {
+		t.Errorf("got %v, want %v", topics, []string{"payments"})
+	}
+}
+
+func TestExpandSubscriptionInvalidPattern(t *testing.T) {
+	gm := &T{}
+	if _, err := gm.expandSubscription(kazoo.RegPattern("bogus"), nil); err == nil {
+		t.Error("expected an error for an unsupported pattern, got nil")
+	}
+}
+
+func TestExpandSubscriptionInvalidRegexp(t *testing.T) {
+	gm := &T{knownTopics: []string{"foo"}}
+	if _, err := gm.expandSubscription(kazoo.PatternWhiteList, []string{"("}); err == nil {
+		t.Error("expected an error for an invalid regexp, got nil")
+	}
+}
+
+func TestExpectedOwners(t *testing.T) {
+	subscriptions := map[string][]string{
+		"m1": {"foo"},
+		"m2": {"foo"},
+		"m3": {"foo"},
+	}
+	owners := expectedOwners(subscriptions, "foo", []int32{0, 1, 2, 3})
+	// Members sorted by ID: m1, m2, m3. Expected owner of partition p is
+	// subscribed[p % len(subscribed)].
+	want := map[int32]string{0: "m1", 1: "m2", 2: "m3", 3: "m1"}
+	if !reflect.DeepEqual(owners, want) {
+		t.Errorf("got %v, want %v", owners, want)
+	}
+}
+
+func TestExpectedOwnersNoSubscribers(t *testing.T) {
+	owners := expectedOwners(map[string][]string{"m1": {"bar"}}, "foo", []int32{0, 1})
+	if owners != nil {
+		t.Errorf("got %v, want nil", owners)
+	}
+}
+
+func TestClaimRank(t *testing.T) {
+	subscriptions := map[string][]string{
+		"m1": {"foo"},
+		"m2": {"foo"},
+		"m3": {"foo"},
+	}
+	tests := []struct {
+		ownID     string
+		partition int32
+		want      int
+	}{
+		// Members sorted by ID: m1, m2, m3. Expected owner of partition p is
+		// subscribed[p % len(subscribed)].
+		{"m1", 0, 0}, // m1 is the expected owner of partition 0.
+		{"m2", 0, 1}, // m2 is one slot past the expected owner.
+		{"m3", 0, 2}, // m3 is two slots past the expected owner.
+		{"m1", 1, 2}, // m2 is the expected owner of partition 1; m1 wraps around.
+		{"m2", 4, 0}, // 4 % 3 == 1, so m2 is again the expected owner.
+	}
+	for _, tt := range tests {
+		gm := &T{
+			groupMemberZNode: &kazoo.ConsumergroupInstance{ID: tt.ownID},
+			subscriptions:    subscriptions,
+		}
+		if got := gm.claimRank("foo", tt.partition); got != tt.want {
+			t.Errorf("claimRank(foo, %d) for %s = %d, want %d", tt.partition, tt.ownID, got, tt.want)
+		}
+	}
+}
+
+func TestClaimRankNoSubscribers(t *testing.T) {
+	gm := &T{
+		groupMemberZNode: &kazoo.ConsumergroupInstance{ID: "m1"},
+		subscriptions:    map[string][]string{"m1": {"bar"}},
+	}
+	if got := gm.claimRank("foo", 0); got != 0 {
+		t.Errorf("got %d, want 0", got)
+	}
+}
+
+func TestWaitOffsetsSettledNoCheckInstalled(t *testing.T) {
+	gm := &T{}
+	if !gm.waitOffsetsSettled([]topicPartition{{topic: "foo", partition: 0}}) {
+		t.Error("expected true when no OffsetCheckFunc is installed")
+	}
+}
+
+func TestWaitOffsetsSettledNothingReleased(t *testing.T) {
+	gm := &T{offsetCheck: func(topic string, partition int32) (int64, int64, error) {
+		t.Fatal("offsetCheck must not be called when nothing was released")
+		return 0, 0, nil
+	}}
+	if !gm.waitOffsetsSettled(nil) {
+		t.Error("expected true when the released set is empty")
+	}
+}
+
+func TestWaitOffsetsSettledAlreadyCaughtUp(t *testing.T) {
+	gm := &T{
+		cfg: &config.Proxy{},
+		offsetCheck: func(topic string, partition int32) (int64, int64, error) {
+			return 42, 42, nil
+		},
+	}
+	released := []topicPartition{{topic: "foo", partition: 0}, {topic: "foo", partition: 1}}
+	if !gm.waitOffsetsSettled(released) {
+		t.Error("expected true when every released partition is already caught up")
+	}
+}